@@ -57,6 +57,8 @@ func (ce *Encoding) Set(s string) error {
 		*ce = DoubleDelta
 	case "2":
 		*ce = Varbit
+	case "3":
+		*ce = XOR
 	default:
 		return fmt.Errorf("invalid chunk encoding: %s", s)
 	}
@@ -70,6 +72,9 @@ const (
 	DoubleDelta
 	// Varbit encoding
 	Varbit
+	// XOR encoding is a Gorilla-style delta-of-delta timestamp and XOR'd
+	// float value encoding. See the doc comment on xorChunk for details.
+	XOR
 )
 
 // ChunkDesc contains meta-data for a chunk. Pay special attention to the
@@ -247,6 +252,7 @@ func (cd *ChunkDesc) MaybeEvict() bool {
 		// This must never happen.
 		panic("ChunkLastTime not populated for evicted chunk")
 	}
+	pool.Put(cd.C)
 	cd.C = nil
 	return true
 }
@@ -271,6 +277,19 @@ type Chunk interface {
 	Encoding() Encoding
 }
 
+// verifiableChunk is implemented by chunk encodings that store a checksum
+// alongside their payload and can verify it on load. It is kept separate
+// from the public Chunk interface, like resettableChunk, because not every
+// encoding carries a checksum.
+type verifiableChunk interface {
+	// Checksum returns a checksum computed over the chunk's encoded
+	// payload, for later verification against a freshly computed value.
+	Checksum() uint32
+	// Verify recomputes the chunk's checksum and compares it against the
+	// one stored alongside the payload, returning an error on mismatch.
+	Verify() error
+}
+
 // ChunkIterator enables efficient access to the content of a chunk. It is
 // generally not safe to use a chunkIterator concurrently with or after chunk
 // mutation.
@@ -369,15 +388,13 @@ func NewChunk() Chunk {
 	return chunk
 }
 
-// NewChunkForEncoding allows configuring what chunk type you want
+// NewChunkForEncoding allows configuring what chunk type you want. The
+// returned chunk is acquired from the package's ChunkPool rather than
+// freshly allocated; see SetChunkPool.
 func NewChunkForEncoding(encoding Encoding) (Chunk, error) {
 	switch encoding {
-	case Delta:
-		return newDeltaEncodedChunk(d1, d0, true, ChunkLen), nil
-	case DoubleDelta:
-		return newDoubleDeltaEncodedChunk(d1, d0, true, ChunkLen), nil
-	case Varbit:
-		return newVarbitChunk(varbitZeroEncoding), nil
+	case Delta, DoubleDelta, Varbit, XOR:
+		return pool.Get(encoding), nil
 	default:
 		return nil, fmt.Errorf("unknown chunk encoding: %v", encoding)
 	}
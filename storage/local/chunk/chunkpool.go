@@ -0,0 +1,145 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chunkPoolRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus",
+		Subsystem: "local_storage",
+		Name:      "chunk_pool_requests_total",
+		Help:      "Total number of chunks requested from the chunk pool.",
+	})
+	chunkPoolMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus",
+		Subsystem: "local_storage",
+		Name:      "chunk_pool_misses_total",
+		Help:      "Total number of chunk pool requests that required allocating a new chunk because none was available for reuse.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(chunkPoolRequests)
+	prometheus.MustRegister(chunkPoolMisses)
+}
+
+// ChunkPool decouples chunk allocation from Go's own allocator, so that a
+// server churning through many short-lived chunks (head chunks, overflow
+// chunks, transcoding targets) does not put every one of them through the
+// garbage collector.
+type ChunkPool interface {
+	// Get returns a Chunk of the given encoding, its payload zeroed,
+	// either recycled from the pool or freshly allocated. It panics if
+	// encoding is not a known encoding.
+	Get(Encoding) Chunk
+	// Put returns a Chunk's backing storage to the pool for later reuse, if
+	// the encoding is able to zero its own payload; otherwise Put is a
+	// no-op and c is left for the garbage collector. Either way, the
+	// caller must not use c again afterwards.
+	Put(Chunk)
+}
+
+// pool is the ChunkPool used by NewChunk, NewChunkForEncoding, and
+// ChunkDesc.MaybeEvict. It defaults to a syncChunkPool but can be swapped
+// out via SetChunkPool, e.g. to disable pooling in tests that want to
+// observe every allocation.
+var pool ChunkPool = newSyncChunkPool()
+
+// SetChunkPool overrides the package-wide ChunkPool.
+func SetChunkPool(p ChunkPool) {
+	pool = p
+}
+
+// resettableChunk is implemented by chunk encodings that know how to zero
+// their own payload for reuse by a ChunkPool. It is kept separate from the
+// public Chunk interface because resetting a chunk you don't exclusively
+// own doesn't make sense outside of pool bookkeeping.
+type resettableChunk interface {
+	reset()
+}
+
+// syncChunkPool is the default ChunkPool, backed by one sync.Pool per
+// resettable encoding so that Get always returns a Chunk of the requested
+// type. Encodings whose chunk type doesn't implement resettableChunk are
+// still known to Get (via alloc), but are never recycled through a
+// sync.Pool, since there would be no way to guarantee their payload is
+// clean before handing them back out.
+type syncChunkPool struct {
+	alloc map[Encoding]func() Chunk
+	pools map[Encoding]*sync.Pool
+}
+
+// newAllocFunc wraps a chunk constructor so that every call -- which
+// sync.Pool only ever makes when it has nothing to reuse -- counts as a
+// pool miss.
+func newAllocFunc(alloc func() Chunk) func() interface{} {
+	return func() interface{} {
+		chunkPoolMisses.Inc()
+		return alloc()
+	}
+}
+
+func newSyncChunkPool() *syncChunkPool {
+	p := &syncChunkPool{
+		alloc: map[Encoding]func() Chunk{
+			Delta:       func() Chunk { return newDeltaEncodedChunk(d1, d0, true, ChunkLen) },
+			DoubleDelta: func() Chunk { return newDoubleDeltaEncodedChunk(d1, d0, true, ChunkLen) },
+			Varbit:      func() Chunk { return newVarbitChunk(varbitZeroEncoding) },
+			XOR:         func() Chunk { return newXORChunk() },
+		},
+	}
+
+	p.pools = make(map[Encoding]*sync.Pool, len(p.alloc))
+	for e, alloc := range p.alloc {
+		if _, ok := alloc().(resettableChunk); ok {
+			p.pools[e] = &sync.Pool{New: newAllocFunc(alloc)}
+		}
+	}
+	return p
+}
+
+func (p *syncChunkPool) Get(e Encoding) Chunk {
+	alloc, ok := p.alloc[e]
+	if !ok {
+		panic(fmt.Sprintf("chunk: unknown encoding %v", e))
+	}
+
+	chunkPoolRequests.Inc()
+	if sp, ok := p.pools[e]; ok {
+		return sp.Get().(Chunk)
+	}
+	// This encoding can't reset its own payload, so it was never put into
+	// p.pools; allocate a fresh chunk every time instead of pooling one
+	// whose cleanliness we couldn't verify.
+	chunkPoolMisses.Inc()
+	return alloc()
+}
+
+func (p *syncChunkPool) Put(c Chunk) {
+	sp, ok := p.pools[c.Encoding()]
+	if !ok {
+		// Either an unknown encoding, or a known one that isn't pooled
+		// because it can't reset itself. Either way, let the garbage
+		// collector reclaim it rather than recycling stale data.
+		return
+	}
+	c.(resettableChunk).reset()
+	sp.Put(c)
+}
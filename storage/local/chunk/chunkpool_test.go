@@ -0,0 +1,69 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// TestChunkPoolGetPutRoundTrip checks, for every encoding the pool claims to
+// support via Get, that a chunk handed back via Put never reappears with
+// samples from its previous use -- whether because the encoding resets
+// itself, or because the pool declined to recycle it at all.
+func TestChunkPoolGetPutRoundTrip(t *testing.T) {
+	p := newSyncChunkPool()
+
+	for e := range p.alloc {
+		t.Run(e.String(), func(t *testing.T) {
+			c := p.Get(e)
+			if c.Encoding() != e {
+				t.Fatalf("got encoding %v, want %v", c.Encoding(), e)
+			}
+			if _, err := c.Add(model.SamplePair{Timestamp: 100, Value: 42}); err != nil {
+				t.Fatalf("Add: %s", err)
+			}
+
+			p.Put(c) // must not panic, regardless of whether e is resettable
+
+			c2 := p.Get(e)
+			if c2.Encoding() != e {
+				t.Fatalf("got encoding %v, want %v", c2.Encoding(), e)
+			}
+			if it := c2.NewIterator(); it.Scan() {
+				t.Fatalf("chunk returned from pool for encoding %v carried a sample from its previous use: %v", e, it.Value())
+			}
+		})
+	}
+}
+
+// TestChunkPoolPutDoesNotPanicForNonResettableEncoding is a regression test
+// for Put panicking on DefaultEncoding (DoubleDelta), which doesn't
+// implement resettableChunk: since MaybeEvict unconditionally calls
+// pool.Put on every evicted chunk, that panic would crash the server on the
+// first eviction of a chunk using the default encoding.
+func TestChunkPoolPutDoesNotPanicForNonResettableEncoding(t *testing.T) {
+	p := newSyncChunkPool()
+
+	c := p.Get(DefaultEncoding)
+	if _, ok := c.(resettableChunk); ok {
+		t.Fatalf("test assumes DefaultEncoding (%v) does not implement resettableChunk", DefaultEncoding)
+	}
+	if _, err := c.Add(model.SamplePair{Timestamp: 1, Value: 1}); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+
+	p.Put(c)
+}
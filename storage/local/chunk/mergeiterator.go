@@ -0,0 +1,329 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"container/heap"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// NewMergeIterator returns a ChunkIterator that streams the samples falling
+// within in across descs, in ascending timestamp order, without requiring
+// the caller to pin more than one chunk deep of memory at a time. descs
+// must be ordered by FirstTime, ascending, as ChunkDescs normally are within
+// a series.
+//
+// Chunks are pinned lazily -- only once the merge actually needs to read
+// from them -- and unpinned as soon as the cursor moves past them, using
+// evictRequests exactly as ChunkDesc.Pin/Unpin expect. If two chunks
+// disagree about the sample at an identical timestamp (as can happen across
+// a chunk boundary), the sample from the chunk later in descs wins, since
+// that is the more recently written one.
+func NewMergeIterator(descs []*ChunkDesc, in metric.Interval, evictRequests chan<- EvictRequest) ChunkIterator {
+	return &mergeIterator{
+		descs:         descs,
+		in:            in,
+		evictRequests: evictRequests,
+	}
+}
+
+// mergeSource is one ChunkDesc's contribution to the merge: its (pinned)
+// iterator, the value it is currently offering, and its position in the
+// original descs slice, which breaks timestamp ties in the heap below.
+type mergeSource struct {
+	desc *ChunkDesc
+	seq  int
+	it   ChunkIterator
+	val  model.SamplePair
+}
+
+// sourceHeap orders mergeSources by the timestamp they are currently
+// offering, breaking ties in favor of the higher seq (i.e. the chunk that
+// was written later), so that Pop always returns whichever source should
+// win a timestamp collision.
+type sourceHeap []*mergeSource
+
+func (h sourceHeap) Len() int { return len(h) }
+func (h sourceHeap) Less(i, j int) bool {
+	if h[i].val.Timestamp.Equal(h[j].val.Timestamp) {
+		return h[i].seq > h[j].seq
+	}
+	return h[i].val.Timestamp.Before(h[j].val.Timestamp)
+}
+func (h sourceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sourceHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+type mergeIterator struct {
+	descs         []*ChunkDesc
+	in            metric.Interval
+	evictRequests chan<- EvictRequest
+
+	nextDescIdx int
+	heap        sourceHeap
+
+	hasLast  bool
+	lastTS   model.Time
+	current  model.SamplePair
+	finished bool
+	err      error
+
+	// pending holds a sample already pulled off the heap by FindAtOrBefore
+	// while it was looking ahead for the first sample past t, but not yet
+	// surfaced as current. The next Scan picks it up before pulling
+	// anything else, so no sample is lost between the two calls.
+	pending *model.SamplePair
+}
+
+// ensureOpen pins and opens descs, in order, until either the heap is
+// non-empty and no unopened desc could possibly contribute a sample at or
+// before the heap's current minimum, or there are no more descs left to open.
+// It returns false if opening a desc failed.
+func (m *mergeIterator) ensureOpen() bool {
+	for m.nextDescIdx < len(m.descs) {
+		next := m.descs[m.nextDescIdx]
+
+		if next.FirstTime().After(m.in.NewestInclusive) {
+			// descs are ordered by FirstTime, so nothing after this one
+			// can be in range either.
+			m.nextDescIdx = len(m.descs)
+			break
+		}
+		if len(m.heap) > 0 && next.FirstTime().After(m.heap[0].val.Timestamp) {
+			break
+		}
+		m.nextDescIdx++
+
+		last, err := next.LastTime()
+		if err != nil {
+			m.err = err
+			return false
+		}
+		if last.Before(m.in.OldestInclusive) {
+			continue // entirely before the requested range
+		}
+		if err := m.open(next, m.nextDescIdx-1); err != nil {
+			m.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// open pins desc, seeks its iterator to the first sample at or after
+// in.OldestInclusive, and -- if it found one -- pushes it onto the heap. If
+// the chunk turns out to hold nothing in range, it is unpinned again
+// immediately.
+func (m *mergeIterator) open(desc *ChunkDesc, seq int) error {
+	desc.Pin(m.evictRequests)
+
+	it := desc.C.NewIterator()
+	if !it.FindAtOrAfter(m.in.OldestInclusive) {
+		err := it.Err()
+		desc.Unpin(m.evictRequests)
+		return err
+	}
+
+	heap.Push(&m.heap, &mergeSource{desc: desc, seq: seq, it: it, val: it.Value()})
+	return nil
+}
+
+// closeAll unpins every chunk still held open. It is called once the merge
+// has produced its last sample, whether because the range is exhausted or
+// because of an error.
+func (m *mergeIterator) closeAll() {
+	for _, src := range m.heap {
+		src.desc.Unpin(m.evictRequests)
+	}
+	m.heap = nil
+	m.nextDescIdx = len(m.descs)
+}
+
+// advance pops and returns the next candidate sample off the heap, in
+// ascending timestamp order, skipping stale duplicates from older,
+// overlapping chunks (a newer chunk already produced a sample at or after
+// that timestamp). It does not apply m.in's bounds; callers decide whether
+// a candidate is in range. ok is false once the heap is permanently
+// exhausted or an unrecoverable error occurred, in which case every pinned
+// chunk has already been unpinned via closeAll.
+func (m *mergeIterator) advance() (model.SamplePair, bool) {
+	for {
+		if !m.ensureOpen() {
+			m.closeAll()
+			return model.SamplePair{}, false
+		}
+		if len(m.heap) == 0 {
+			m.closeAll()
+			return model.SamplePair{}, false
+		}
+
+		top := heap.Pop(&m.heap).(*mergeSource)
+		ts, val := top.val.Timestamp, top.val
+
+		if top.it.Scan() {
+			top.val = top.it.Value()
+			heap.Push(&m.heap, top)
+		} else if err := top.it.Err(); err != nil {
+			top.desc.Unpin(m.evictRequests)
+			m.err = err
+			m.closeAll()
+			return model.SamplePair{}, false
+		} else {
+			top.desc.Unpin(m.evictRequests)
+		}
+
+		if m.hasLast && !ts.After(m.lastTS) {
+			continue
+		}
+		return val, true
+	}
+}
+
+// Scan implements ChunkIterator.
+func (m *mergeIterator) Scan() bool {
+	if m.finished || m.err != nil {
+		return false
+	}
+
+	for {
+		var val model.SamplePair
+		if m.pending != nil {
+			val = *m.pending
+			m.pending = nil
+		} else {
+			v, ok := m.advance()
+			if !ok {
+				m.finished = true
+				return false
+			}
+			val = v
+		}
+
+		if val.Timestamp.Before(m.in.OldestInclusive) {
+			continue
+		}
+		if val.Timestamp.After(m.in.NewestInclusive) {
+			m.closeAll()
+			m.finished = true
+			return false
+		}
+
+		m.current = val
+		m.lastTS = val.Timestamp
+		m.hasLast = true
+		return true
+	}
+}
+
+// LastTimestamp implements ChunkIterator.
+func (m *mergeIterator) LastTimestamp() (model.Time, error) {
+	var last model.Time
+	for i, desc := range m.descs {
+		t, err := desc.LastTime()
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || t.After(last) {
+			last = t
+		}
+	}
+	return last, nil
+}
+
+// Contains implements ChunkIterator.
+func (m *mergeIterator) Contains(t model.Time) (bool, error) {
+	if len(m.descs) == 0 {
+		return false, nil
+	}
+	last, err := m.LastTimestamp()
+	if err != nil {
+		return false, err
+	}
+	return !t.Before(m.descs[0].FirstTime()) && !t.After(last), nil
+}
+
+// FindAtOrAfter implements ChunkIterator. It restarts the merge with its
+// oldest bound set to t.
+func (m *mergeIterator) FindAtOrAfter(t model.Time) bool {
+	m.restart(t, m.in.NewestInclusive)
+	return m.Scan()
+}
+
+// FindAtOrBefore implements ChunkIterator. Because the merge only streams
+// forward, finding the sample at or before t means restarting the merge and
+// scanning ahead until a sample past t turns up. That overshoot sample is
+// kept as m.pending rather than discarded, so the configured upper bound is
+// left untouched and a later Scan still produces it, exactly as if
+// FindAtOrBefore had merely repositioned the cursor. The scan-ahead itself
+// stops at the first sample past NewestInclusive, even if t is beyond it, so a
+// caller passing an out-of-range t cannot make the iterator read or pin
+// chunks outside the range it was constructed for.
+func (m *mergeIterator) FindAtOrBefore(t model.Time) bool {
+	cutoff := t
+	if m.in.NewestInclusive.Before(cutoff) {
+		cutoff = m.in.NewestInclusive
+	}
+
+	m.restart(m.in.OldestInclusive, m.in.NewestInclusive)
+	found := false
+	for {
+		val, ok := m.advance()
+		if !ok {
+			m.finished = true
+			break
+		}
+		if val.Timestamp.Before(m.in.OldestInclusive) {
+			continue
+		}
+		if val.Timestamp.After(cutoff) {
+			m.pending = &val
+			break
+		}
+
+		m.current = val
+		m.lastTS = val.Timestamp
+		m.hasLast = true
+		found = true
+	}
+	return found && m.err == nil
+}
+
+func (m *mergeIterator) restart(oldest, newest model.Time) {
+	m.closeAll()
+	m.nextDescIdx = 0
+	m.hasLast = false
+	m.finished = false
+	m.err = nil
+	m.pending = nil
+	m.in = metric.Interval{OldestInclusive: oldest, NewestInclusive: newest}
+}
+
+// Value implements ChunkIterator.
+func (m *mergeIterator) Value() model.SamplePair {
+	return m.current
+}
+
+// Err implements ChunkIterator.
+func (m *mergeIterator) Err() error {
+	return m.err
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// newTestChunkDesc builds a ChunkDesc wrapping a single XOR chunk holding
+// samples, which must fit without overflowing. Its refCount starts at 1, as
+// NewChunkDesc always leaves it, so a balanced sequence of Pin/Unpin calls
+// (as the merge iterator makes) never touches the evict-list channel.
+func newTestChunkDesc(t *testing.T, samples []model.SamplePair) *ChunkDesc {
+	t.Helper()
+	c := newXORChunk()
+	var chunk Chunk = c
+	for _, s := range samples {
+		next, err := chunk.Add(s)
+		if err != nil {
+			t.Fatalf("Add(%v): %s", s, err)
+		}
+		if len(next) != 1 {
+			t.Fatalf("sample set overflowed a single chunk; shrink it for this test")
+		}
+		chunk = next[0]
+	}
+	desc := NewChunkDesc(chunk, samples[0].Timestamp)
+	desc.ChunkLastTime = samples[len(samples)-1].Timestamp
+	return desc
+}
+
+// drain calls Scan until it returns false and collects every value seen.
+func drain(it ChunkIterator) []model.SamplePair {
+	var got []model.SamplePair
+	for it.Scan() {
+		got = append(got, it.Value())
+	}
+	return got
+}
+
+func assertMergedSamplesEqual(t *testing.T, got, want []model.SamplePair) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples %v, want %d samples %v", len(got), got, len(want), want)
+	}
+	for i, w := range want {
+		if got[i].Timestamp != w.Timestamp || got[i].Value != w.Value {
+			t.Errorf("sample %d: got %v, want %v", i, got[i], w)
+		}
+	}
+}
+
+// TestMergeIteratorOverlapNewestWins checks that when two overlapping chunks
+// disagree about the sample at an identical timestamp, the chunk later in
+// descs (the more recently written one) wins, the older duplicate is
+// dropped, and every chunk ends up pinned and unpinned in balance.
+func TestMergeIteratorOverlapNewestWins(t *testing.T) {
+	older := newTestChunkDesc(t, []model.SamplePair{
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 20, Value: 2}, // stale: superseded by newer below
+	})
+	newer := newTestChunkDesc(t, []model.SamplePair{
+		{Timestamp: 20, Value: 999}, // wins the tie against older's t=20
+		{Timestamp: 30, Value: 3},
+	})
+
+	evictRequests := make(chan EvictRequest, 10)
+	it := NewMergeIterator(
+		[]*ChunkDesc{older, newer},
+		metric.Interval{OldestInclusive: 0, NewestInclusive: 100},
+		evictRequests,
+	)
+
+	got := drain(it)
+	if it.Err() != nil {
+		t.Fatalf("Err: %s", it.Err())
+	}
+	assertMergedSamplesEqual(t, got, []model.SamplePair{
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 20, Value: 999},
+		{Timestamp: 30, Value: 3},
+	})
+
+	if rc := older.RefCount(); rc != 1 {
+		t.Errorf("older.RefCount() = %d, want 1 (pins and unpins should balance back to the initial refcount)", rc)
+	}
+	if rc := newer.RefCount(); rc != 1 {
+		t.Errorf("newer.RefCount() = %d, want 1 (pins and unpins should balance back to the initial refcount)", rc)
+	}
+}
+
+// TestMergeIteratorFindAtOrBeforeThenScanContinues is a regression test for
+// FindAtOrBefore permanently clamping the iterator's upper bound (commit
+// e149dac), fixed without a test in 4b4fcd2: after finding the sample at or
+// before t, Scan must still be able to produce samples beyond t.
+func TestMergeIteratorFindAtOrBeforeThenScanContinues(t *testing.T) {
+	desc := newTestChunkDesc(t, []model.SamplePair{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 20, Value: 2},
+		{Timestamp: 30, Value: 3},
+		{Timestamp: 40, Value: 4},
+	})
+
+	evictRequests := make(chan EvictRequest, 10)
+	it := NewMergeIterator(
+		[]*ChunkDesc{desc},
+		metric.Interval{OldestInclusive: 0, NewestInclusive: 100},
+		evictRequests,
+	)
+
+	if !it.FindAtOrBefore(25) {
+		t.Fatalf("FindAtOrBefore(25): got false, want true")
+	}
+	if got, want := it.Value().Timestamp, model.Time(20); got != want {
+		t.Fatalf("FindAtOrBefore(25): got timestamp %v, want %v", got, want)
+	}
+
+	want := []model.SamplePair{
+		{Timestamp: 30, Value: 3},
+		{Timestamp: 40, Value: 4},
+	}
+	var got []model.SamplePair
+	for it.Scan() {
+		got = append(got, it.Value())
+	}
+	if it.Err() != nil {
+		t.Fatalf("Err: %s", it.Err())
+	}
+	assertMergedSamplesEqual(t, got, want)
+}
+
+// TestMergeIteratorFindAtOrBeforeRespectsNewestBound checks that
+// FindAtOrBefore(t) with t at or beyond the iterator's configured
+// NewestInclusive does not surface (or keep scanning into) samples past
+// NewestInclusive.
+func TestMergeIteratorFindAtOrBeforeRespectsNewestBound(t *testing.T) {
+	desc := newTestChunkDesc(t, []model.SamplePair{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 20, Value: 2},
+		{Timestamp: 30, Value: 3}, // beyond NewestInclusive below
+		{Timestamp: 40, Value: 4}, // beyond NewestInclusive below
+	})
+
+	evictRequests := make(chan EvictRequest, 10)
+	it := NewMergeIterator(
+		[]*ChunkDesc{desc},
+		metric.Interval{OldestInclusive: 0, NewestInclusive: 25},
+		evictRequests,
+	)
+
+	if !it.FindAtOrBefore(1000) {
+		t.Fatalf("FindAtOrBefore(1000): got false, want true")
+	}
+	if got, want := it.Value().Timestamp, model.Time(20); got != want {
+		t.Fatalf("FindAtOrBefore(1000): got timestamp %v, want %v (must not surface samples past NewestInclusive)", got, want)
+	}
+	if it.Scan() {
+		t.Fatalf("Scan() after FindAtOrBefore(1000): got a further sample %v, want none within NewestInclusive", it.Value())
+	}
+	if it.Err() != nil {
+		t.Fatalf("Err: %s", it.Err())
+	}
+}
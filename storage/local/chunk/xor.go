@@ -0,0 +1,606 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/prometheus/common/model"
+)
+
+// xorChecksumLen is the size, in bytes, of the CRC32C checksum reserved at
+// the very start of an xorChunk's payload.
+const xorChecksumLen = 4
+
+// xorHeaderLen is the size, in bytes, of the fixed header xorChunk keeps at
+// the start of its payload: the checksum, followed by a sample count and a
+// bit cursor, both big-endian uint16s.
+const xorHeaderLen = xorChecksumLen + 4
+
+// xorBitCap is the number of bits available to the bitstream that follows
+// the header, filling out the rest of the ChunkLen-byte payload.
+const xorBitCap = (ChunkLen - xorHeaderLen) * 8
+
+// crc32cTable is the Castagnoli CRC32 table used by xorChunk.Checksum, the
+// same polynomial used elsewhere for checksums that favor error-detection
+// quality over compatibility with the original (IEEE) CRC32.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// xorChunk implements Chunk using the encoding described in Facebook's
+// "Gorilla: A Fast, Scalable, In-Memory Time Series Database" (VLDB 2015).
+// Timestamps are stored as the first absolute timestamp, followed by a
+// first delta, followed by delta-of-deltas encoded with a small set of
+// variable-length bit patterns; values are stored as the first value in
+// full, followed by each subsequent value XOR'd against its predecessor and
+// encoded as either "identical to the previous value", "meaningful bits
+// fall within the previous block's leading/trailing zero window", or "start
+// a new window". Both schemes compress far better than DoubleDelta or
+// Varbit for typical monotonic counters, at the cost of the payload no
+// longer being randomly addressable by sample index.
+//
+// The payload is a fixed ChunkLen-byte array: an 8-byte header (a CRC32C
+// checksum, a sample count, and a bit cursor) followed by the bitstream.
+// Add reports an overflow chunk, via the same mechanism as the other
+// encodings, once the bit cursor would exceed the payload.
+type xorChunk struct {
+	b [ChunkLen]byte
+
+	// The following fields mirror the tail of the bitstream so that Add
+	// can keep appending without redecoding the payload. They carry no
+	// information not already implied by b[:xorHeaderLen+ceil(pos/8)];
+	// bootstrap recomputes them from the payload after
+	// Unmarshal/UnmarshalFromBuf.
+	num      uint16
+	pos      uint16
+	t0       model.Time
+	t        model.Time
+	tDelta   int64
+	value    float64
+	leading  uint8
+	trailing uint8
+}
+
+// newXORChunk returns a new, empty xorChunk.
+func newXORChunk() *xorChunk {
+	return &xorChunk{leading: 0xff}
+}
+
+// Add implements Chunk.
+func (c *xorChunk) Add(s model.SamplePair) ([]Chunk, error) {
+	w := bitWriter{b: c.b[xorHeaderLen:], pos: c.pos}
+
+	switch c.num {
+	case 0:
+		if !w.writeBits(uint64(int64(s.Timestamp)), 64) ||
+			!w.writeValue(float64(s.Value), 0, &c.leading, &c.trailing, true) {
+			return addToOverflowChunk(c, s)
+		}
+		c.t0 = s.Timestamp
+	case 1:
+		delta := int64(s.Timestamp) - int64(c.t)
+		if !w.writeBits(uint64(uint32(delta)), 32) ||
+			!w.writeValue(float64(s.Value), c.value, &c.leading, &c.trailing, false) {
+			return addToOverflowChunk(c, s)
+		}
+		c.tDelta = delta
+	default:
+		delta := int64(s.Timestamp) - int64(c.t)
+		if !w.writeDoD(delta-c.tDelta) ||
+			!w.writeValue(float64(s.Value), c.value, &c.leading, &c.trailing, false) {
+			return addToOverflowChunk(c, s)
+		}
+		c.tDelta = delta
+	}
+
+	c.t = s.Timestamp
+	c.value = float64(s.Value)
+	c.pos = w.pos
+	c.num++
+	binary.BigEndian.PutUint16(c.b[xorChecksumLen:xorChecksumLen+2], c.num)
+	binary.BigEndian.PutUint16(c.b[xorChecksumLen+2:xorHeaderLen], c.pos)
+
+	return []Chunk{c}, nil
+}
+
+// Clone implements Chunk.
+func (c *xorChunk) Clone() Chunk {
+	clone := *c
+	return &clone
+}
+
+// FirstTime implements Chunk.
+func (c *xorChunk) FirstTime() model.Time {
+	return c.t0
+}
+
+// NewIterator implements Chunk.
+func (c *xorChunk) NewIterator() ChunkIterator {
+	return c.iterator()
+}
+
+func (c *xorChunk) iterator() *xorChunkIterator {
+	return &xorChunkIterator{
+		c:   c,
+		br:  bitReader{b: c.b[xorHeaderLen:], len: c.pos},
+		num: int(c.num),
+	}
+}
+
+// Marshal implements Chunk.
+func (c *xorChunk) Marshal(w io.Writer) error {
+	binary.BigEndian.PutUint32(c.b[0:xorChecksumLen], c.Checksum())
+	_, err := w.Write(c.b[:])
+	return err
+}
+
+// MarshalToBuf implements Chunk.
+func (c *xorChunk) MarshalToBuf(buf []byte) error {
+	if len(buf) < len(c.b) {
+		return errChunkBoundsExceeded
+	}
+	binary.BigEndian.PutUint32(c.b[0:xorChecksumLen], c.Checksum())
+	copy(buf, c.b[:])
+	return nil
+}
+
+// Unmarshal implements Chunk.
+func (c *xorChunk) Unmarshal(r io.Reader) error {
+	if _, err := io.ReadFull(r, c.b[:]); err != nil {
+		return err
+	}
+	if err := c.Verify(); err != nil {
+		return err
+	}
+	return c.bootstrap()
+}
+
+// UnmarshalFromBuf implements Chunk.
+func (c *xorChunk) UnmarshalFromBuf(buf []byte) error {
+	if len(buf) < len(c.b) {
+		return errChunkBoundsExceeded
+	}
+	copy(c.b[:], buf)
+	if err := c.Verify(); err != nil {
+		return err
+	}
+	return c.bootstrap()
+}
+
+// Encoding implements Chunk.
+func (c *xorChunk) Encoding() Encoding { return XOR }
+
+// Checksum implements verifiableChunk. It is a CRC32C checksum computed over the
+// payload following the checksum field itself, so it never covers its own
+// bytes.
+func (c *xorChunk) Checksum() uint32 {
+	return crc32.Checksum(c.b[xorChecksumLen:], crc32cTable)
+}
+
+// Verify implements verifiableChunk. A mismatch here is the signature of on-disk
+// corruption -- bit rot or a truncated write -- rather than an encoder bug,
+// which today is only caught opportunistically when decoding stumbles on an
+// impossible value.
+func (c *xorChunk) Verify() error {
+	stored := binary.BigEndian.Uint32(c.b[0:xorChecksumLen])
+	if got := c.Checksum(); got != stored {
+		return fmt.Errorf("chunk: checksum mismatch: stored %08x, computed %08x", stored, got)
+	}
+	return nil
+}
+
+// reset implements resettableChunk, zeroing c so that a ChunkPool can hand
+// it back out as if freshly allocated.
+func (c *xorChunk) reset() {
+	*c = xorChunk{leading: 0xff}
+}
+
+// bootstrap replays the encoded bitstream once to recompute the in-memory
+// cursor state (t0, t, tDelta, value, leading, trailing) that Add needs to
+// keep appending samples after the payload has been loaded from disk.
+func (c *xorChunk) bootstrap() error {
+	c.num = binary.BigEndian.Uint16(c.b[xorChecksumLen : xorChecksumLen+2])
+	c.pos = binary.BigEndian.Uint16(c.b[xorChecksumLen+2 : xorHeaderLen])
+	c.t0, c.t, c.tDelta, c.value = 0, 0, 0, 0
+	c.leading, c.trailing = 0xff, 0
+
+	if c.num == 0 {
+		return nil
+	}
+
+	it := c.iterator()
+	first := true
+	for it.Scan() {
+		if first {
+			c.t0 = it.t0
+			first = false
+		}
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+
+	c.t = it.t
+	c.tDelta = it.tDelta
+	c.value = it.value
+	c.leading = it.leading
+	c.trailing = it.trailing
+	return nil
+}
+
+// xorChunkIterator implements ChunkIterator for xorChunk. The Gorilla
+// encoding is inherently sequential, so FindAtOrBefore and FindAtOrAfter
+// decode from the start of the chunk rather than seeking directly.
+type xorChunkIterator struct {
+	c   *xorChunk
+	br  bitReader
+	num int
+	idx int
+
+	t0       model.Time
+	t        model.Time
+	tDelta   int64
+	value    float64
+	leading  uint8
+	trailing uint8
+
+	lastValue model.SamplePair
+	err       error
+}
+
+// Scan implements ChunkIterator.
+func (it *xorChunkIterator) Scan() bool {
+	if it.err != nil || it.idx >= it.num {
+		return false
+	}
+
+	switch it.idx {
+	case 0:
+		tbits, ok := it.br.readBits(64)
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		v, ok := it.br.readValue(0, &it.leading, &it.trailing, true)
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		it.t0 = model.Time(int64(tbits))
+		it.t = it.t0
+		it.value = v
+	case 1:
+		delta, ok := it.br.readBits(32)
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		v, ok := it.br.readValue(it.value, &it.leading, &it.trailing, false)
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		it.tDelta = int64(int32(delta))
+		it.t = model.Time(int64(it.t) + it.tDelta)
+		it.value = v
+	default:
+		dod, ok := it.br.readDoD()
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		v, ok := it.br.readValue(it.value, &it.leading, &it.trailing, false)
+		if !ok {
+			it.err = errChunkBoundsExceeded
+			return false
+		}
+		it.tDelta += dod
+		it.t = model.Time(int64(it.t) + it.tDelta)
+		it.value = v
+	}
+
+	it.lastValue = model.SamplePair{Timestamp: it.t, Value: model.SampleValue(it.value)}
+	it.idx++
+	return true
+}
+
+// LastTimestamp implements ChunkIterator.
+func (it *xorChunkIterator) LastTimestamp() (model.Time, error) {
+	fresh := it.c.iterator()
+	var last model.Time
+	for fresh.Scan() {
+		last = fresh.t
+	}
+	return last, fresh.Err()
+}
+
+// Contains implements ChunkIterator.
+func (it *xorChunkIterator) Contains(t model.Time) (bool, error) {
+	last, err := it.LastTimestamp()
+	if err != nil {
+		return false, err
+	}
+	return !t.Before(it.c.t0) && !t.After(last), nil
+}
+
+// FindAtOrBefore implements ChunkIterator.
+func (it *xorChunkIterator) FindAtOrBefore(t model.Time) bool {
+	fresh := it.c.iterator()
+	var match *xorChunkIterator
+	for fresh.Scan() {
+		if fresh.t.After(t) {
+			break
+		}
+		snapshot := *fresh
+		match = &snapshot
+	}
+	if fresh.Err() != nil {
+		it.err = fresh.Err()
+		return false
+	}
+	if match == nil {
+		return false
+	}
+	*it = *match
+	return true
+}
+
+// FindAtOrAfter implements ChunkIterator.
+func (it *xorChunkIterator) FindAtOrAfter(t model.Time) bool {
+	fresh := it.c.iterator()
+	for fresh.Scan() {
+		if !fresh.t.Before(t) {
+			*it = *fresh
+			return true
+		}
+	}
+	if fresh.Err() != nil {
+		it.err = fresh.Err()
+	}
+	return false
+}
+
+// Value implements ChunkIterator.
+func (it *xorChunkIterator) Value() model.SamplePair {
+	return it.lastValue
+}
+
+// Err implements ChunkIterator.
+func (it *xorChunkIterator) Err() error {
+	return it.err
+}
+
+// bitWriter appends bits, most-significant-bit first, to a fixed byte
+// slice. Writes past the end of the slice fail rather than allocate, which
+// is how xorChunk.Add detects that a chunk is full.
+type bitWriter struct {
+	b   []byte
+	pos uint16
+}
+
+func (w *bitWriter) writeBit(bit bool) bool {
+	if int(w.pos) >= len(w.b)*8 {
+		return false
+	}
+	byteIdx, bitIdx := w.pos/8, 7-w.pos%8
+	if bit {
+		w.b[byteIdx] |= 1 << bitIdx
+	} else {
+		w.b[byteIdx] &^= 1 << bitIdx
+	}
+	w.pos++
+	return true
+}
+
+func (w *bitWriter) writeBits(u uint64, nbits uint) bool {
+	for i := int(nbits) - 1; i >= 0; i-- {
+		if !w.writeBit((u>>uint(i))&1 == 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeDoD encodes a timestamp delta-of-delta using the bit patterns from
+// the Gorilla paper: '0' for no change, and '10', '110', '1110', '1111'
+// prefixes for successively wider (and ultimately, a 32-bit fallback)
+// two's-complement windows. Each window's bounds are exactly what its bit
+// width can hold as two's complement ([-64,63], [-256,255], [-2048,2047]),
+// matching readDoD's plain sign-extending decode.
+func (w *bitWriter) writeDoD(dod int64) bool {
+	switch {
+	case dod == 0:
+		return w.writeBit(false)
+	case -64 <= dod && dod <= 63:
+		return w.writeBits(0x2, 2) && w.writeBits(uint64(dod)&0x7f, 7)
+	case -256 <= dod && dod <= 255:
+		return w.writeBits(0x6, 3) && w.writeBits(uint64(dod)&0x1ff, 9)
+	case -2048 <= dod && dod <= 2047:
+		return w.writeBits(0xe, 4) && w.writeBits(uint64(dod)&0xfff, 12)
+	default:
+		return w.writeBits(0xf, 4) && w.writeBits(uint64(uint32(dod)), 32)
+	}
+}
+
+// writeValue XOR-encodes value against prev using the Gorilla scheme: a '0'
+// bit if the two are identical, a '10' bit plus payload if the XOR's
+// meaningful bits fit within the previous block's leading/trailing zero
+// window, or a '11' bit plus a new (leading, meaningful-bit-count,
+// meaningful bits) tuple otherwise. leading is 0xff to mean "no window has
+// been established yet", which forces the first non-identical value to
+// start a new block.
+func (w *bitWriter) writeValue(value, prev float64, leading, trailing *uint8, first bool) bool {
+	if first {
+		return w.writeBits(math.Float64bits(value), 64)
+	}
+
+	vDelta := math.Float64bits(value) ^ math.Float64bits(prev)
+	if vDelta == 0 {
+		return w.writeBit(false)
+	}
+	if !w.writeBit(true) {
+		return false
+	}
+
+	lead := uint8(bits.LeadingZeros64(vDelta))
+	if lead > 31 {
+		// Only 5 bits are used to store the leading-zero count.
+		lead = 31
+	}
+	trail := uint8(bits.TrailingZeros64(vDelta))
+
+	if *leading != 0xff && lead >= *leading && trail >= *trailing {
+		sigbits := uint(64 - int(*leading) - int(*trailing))
+		return w.writeBit(false) && w.writeBits(vDelta>>*trailing, sigbits)
+	}
+
+	*leading, *trailing = lead, trail
+	sigbits := 64 - int(lead) - int(trail)
+	encodedSigbits := sigbits
+	if encodedSigbits == 64 {
+		encodedSigbits = 0
+	}
+	return w.writeBit(true) &&
+		w.writeBits(uint64(lead), 5) &&
+		w.writeBits(uint64(encodedSigbits), 6) &&
+		w.writeBits(vDelta>>trail, uint(sigbits))
+}
+
+// bitReader is the read-side counterpart of bitWriter.
+type bitReader struct {
+	b   []byte
+	pos uint16
+	len uint16 // number of valid bits in b, starting at bit 0
+}
+
+func (r *bitReader) readBit() (bool, bool) {
+	if r.pos >= r.len {
+		return false, false
+	}
+	byteIdx, bitIdx := r.pos/8, 7-r.pos%8
+	bit := r.b[byteIdx]&(1<<bitIdx) != 0
+	r.pos++
+	return bit, true
+}
+
+func (r *bitReader) readBits(nbits uint) (uint64, bool) {
+	var u uint64
+	for i := uint(0); i < nbits; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, true
+}
+
+// readDoD is the inverse of bitWriter.writeDoD.
+func (r *bitReader) readDoD() (int64, bool) {
+	var prefix uint
+	for prefix < 4 {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if !bit {
+			break
+		}
+		prefix++
+	}
+
+	var nbits uint
+	switch prefix {
+	case 0:
+		return 0, true
+	case 1:
+		nbits = 7
+	case 2:
+		nbits = 9
+	case 3:
+		nbits = 12
+	default:
+		nbits = 32
+	}
+
+	v, ok := r.readBits(nbits)
+	if !ok {
+		return 0, false
+	}
+	if nbits == 32 {
+		return int64(int32(v)), true
+	}
+	return signExtend(v, nbits), true
+}
+
+// readValue is the inverse of bitWriter.writeValue.
+func (r *bitReader) readValue(prev float64, leading, trailing *uint8, first bool) (float64, bool) {
+	if first {
+		v, ok := r.readBits(64)
+		if !ok {
+			return 0, false
+		}
+		return math.Float64frombits(v), true
+	}
+
+	identical, ok := r.readBit()
+	if !ok {
+		return 0, false
+	}
+	if !identical {
+		return prev, true
+	}
+
+	newBlock, ok := r.readBit()
+	if !ok {
+		return 0, false
+	}
+	if newBlock {
+		lead, ok := r.readBits(5)
+		if !ok {
+			return 0, false
+		}
+		sig, ok := r.readBits(6)
+		if !ok {
+			return 0, false
+		}
+		sigbits := int(sig)
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		*leading = uint8(lead)
+		*trailing = uint8(64 - int(lead) - sigbits)
+	}
+
+	sigbits := uint(64 - int(*leading) - int(*trailing))
+	v, ok := r.readBits(sigbits)
+	if !ok {
+		return 0, false
+	}
+	vbits := (v << *trailing) ^ math.Float64bits(prev)
+	return math.Float64frombits(vbits), true
+}
+
+// signExtend sign-extends the low nbits bits of v into a full int64.
+func signExtend(v uint64, nbits uint) int64 {
+	shift := 64 - nbits
+	return int64(v<<shift) >> shift
+}
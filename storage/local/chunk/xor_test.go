@@ -0,0 +1,200 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// addAll adds samples to c in order, following any overflow chunks Add
+// reports, and returns the full chain (c first, overflow chunks after).
+func addAll(t *testing.T, c Chunk, samples []model.SamplePair) []Chunk {
+	t.Helper()
+	chunks := []Chunk{c}
+	for _, s := range samples {
+		head := chunks[len(chunks)-1]
+		next, err := head.Add(s)
+		if err != nil {
+			t.Fatalf("Add(%v): %s", s, err)
+		}
+		chunks = chunks[:len(chunks)-1]
+		chunks = append(chunks, next...)
+	}
+	return chunks
+}
+
+// collect decodes every sample out of chunks, in order.
+func collect(t *testing.T, chunks []Chunk) []model.SamplePair {
+	t.Helper()
+	var got []model.SamplePair
+	for _, c := range chunks {
+		it := c.NewIterator()
+		for it.Scan() {
+			got = append(got, it.Value())
+		}
+		if it.Err() != nil {
+			t.Fatalf("iterator error: %s", it.Err())
+		}
+	}
+	return got
+}
+
+func assertSamplesEqual(t *testing.T, got, want []model.SamplePair) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Timestamp != w.Timestamp || got[i].Value != w.Value {
+			t.Errorf("sample %d: got %v, want %v", i, got[i], w)
+		}
+	}
+}
+
+func TestXORChunkRoundTrip(t *testing.T) {
+	samples := []model.SamplePair{
+		{Timestamp: 1000, Value: 3.1415},
+		{Timestamp: 1010, Value: 3.1415}, // identical value
+		{Timestamp: 1025, Value: 4.0},
+		{Timestamp: 1026, Value: 4.0000001}, // tiny XOR, same window
+		{Timestamp: 2026, Value: -17.5},     // forces a new window
+	}
+
+	chunks := addAll(t, newXORChunk(), samples)
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	assertSamplesEqual(t, collect(t, chunks), samples)
+}
+
+// TestXORChunkDoDBoundaries checks that the delta-of-delta prefix switch
+// points from writeDoD/readDoD (dod == 0; the 7-, 9- and 12-bit windows;
+// and the 32-bit fallback) all round-trip correctly at their edges.
+func TestXORChunkDoDBoundaries(t *testing.T) {
+	cases := []struct {
+		name string
+		dods []int64
+	}{
+		{"zero", []int64{0, 0, 0}},
+		{"7-bit window edges", []int64{-64, 63}},
+		{"9-bit window edges", []int64{-256, 255}},
+		{"12-bit window edges", []int64{-2048, 2047}},
+		{"32-bit fallback", []int64{2048, -2049, math.MaxInt32, math.MinInt32}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Two timestamps establish t0 and a first delta before any
+			// dod is encoded, then each entry in tc.dods is applied as the
+			// delta-of-delta against the running delta.
+			ts := []model.Time{0, 1000}
+			delta := int64(1000)
+			for _, dod := range tc.dods {
+				delta += dod
+				ts = append(ts, ts[len(ts)-1]+model.Time(delta))
+			}
+
+			samples := make([]model.SamplePair, len(ts))
+			for i, tv := range ts {
+				samples[i] = model.SamplePair{Timestamp: tv, Value: 1.0}
+			}
+
+			chunks := addAll(t, newXORChunk(), samples)
+			if len(chunks) != 1 {
+				t.Fatalf("got %d chunks, want 1", len(chunks))
+			}
+			assertSamplesEqual(t, collect(t, chunks), samples)
+		})
+	}
+}
+
+// TestXORChunkValueWindowing exercises writeValue/readValue's three cases:
+// an identical value, a value whose meaningful bits fit the previous
+// leading/trailing zero window, and a value that must start a new window.
+func TestXORChunkValueWindowing(t *testing.T) {
+	samples := []model.SamplePair{
+		{Timestamp: 0, Value: 100.0},       // first value, written in full
+		{Timestamp: 1, Value: 100.0},       // identical
+		{Timestamp: 2, Value: 100.5},       // new window
+		{Timestamp: 3, Value: 100.0},       // reuses the window from 100.5
+		{Timestamp: 4, Value: 1e10},        // forces a new, wider window
+		{Timestamp: 5, Value: 1e10 + 2048}, // reuses that new window
+	}
+
+	chunks := addAll(t, newXORChunk(), samples)
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	assertSamplesEqual(t, collect(t, chunks), samples)
+}
+
+// TestXORChunkOverflow checks that once a chunk's bitstream would exceed
+// xorBitCap, Add spills into an overflow chunk rather than corrupting or
+// truncating the current one, and that every sample is still recoverable
+// across the resulting chain.
+func TestXORChunkOverflow(t *testing.T) {
+	var samples []model.SamplePair
+	// Large, varying deltas and values defeat the windowing/DoD
+	// compression enough to force an overflow well before any reasonable
+	// sample count limit.
+	for i := 0; i < 2000; i++ {
+		samples = append(samples, model.SamplePair{
+			Timestamp: model.Time(i * (1 + i%13) * 1013),
+			Value:     model.SampleValue(math.Sqrt(float64(i)) * 1e7),
+		})
+	}
+
+	chunks := addAll(t, newXORChunk(), samples)
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want at least 2 (expected an overflow)", len(chunks))
+	}
+	assertSamplesEqual(t, collect(t, chunks), samples)
+}
+
+func TestXORChunkMarshalUnmarshalRoundTrip(t *testing.T) {
+	samples := []model.SamplePair{
+		{Timestamp: 0, Value: 1.5},
+		{Timestamp: 10, Value: 2.5},
+		{Timestamp: 25, Value: 2.5},
+	}
+	c := newXORChunk()
+	if _, err := c.Add(samples[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range samples[1:] {
+		if _, err := c.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, ChunkLen)
+	if err := c.MarshalToBuf(buf); err != nil {
+		t.Fatalf("MarshalToBuf: %s", err)
+	}
+
+	restored := newXORChunk()
+	if err := restored.UnmarshalFromBuf(buf); err != nil {
+		t.Fatalf("UnmarshalFromBuf: %s", err)
+	}
+	assertSamplesEqual(t, collect(t, []Chunk{restored}), samples)
+
+	// A single corrupted payload byte must be caught by Verify.
+	buf[xorHeaderLen] ^= 0xff
+	if err := newXORChunk().UnmarshalFromBuf(buf); err == nil {
+		t.Fatal("UnmarshalFromBuf on corrupted payload: got nil error, want checksum mismatch")
+	}
+}
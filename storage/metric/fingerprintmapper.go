@@ -0,0 +1,138 @@
+// Copyright 2013 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// labelSeparator joins "name=value" pairs when building the canonical string
+// representation of a metric's label set below. It is not a character that
+// can legally appear in a label value, so two different label sets can never
+// canonicalize to the same string.
+const labelSeparator = "\xff"
+
+// canonicalLabelString returns a string representation of m's label set that
+// is identical for any two metrics carrying the same labels, regardless of
+// the order in which those labels were set.
+func canonicalLabelString(m clientmodel.Metric) string {
+	pairs := make([]string, 0, len(m))
+	for name, value := range m {
+		pairs = append(pairs, string(name)+"="+string(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, labelSeparator)
+}
+
+// metricsEqual reports whether a and b carry exactly the same label set.
+func metricsEqual(a, b clientmodel.Metric) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if bValue, ok := b[name]; !ok || bValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// FingerprintMapper guarantees a unique mapped fingerprint per distinct
+// clientmodel.Metric, even though the raw fingerprints handed to it (which
+// are computed from a hash of the label set) are not guaranteed to be
+// collision-free. Metrics that raw-hash to a fingerprint already used by a
+// different metric are assigned a deterministically chosen stand-in
+// fingerprint, and that assignment is remembered for the lifetime of the
+// mapper so the same metric always maps to the same fingerprint again.
+//
+// A FingerprintMapper holds no reference to the series it maps fingerprints
+// for; its mapping table is rebuilt for free as a side effect of replaying
+// the AppendSample calls that populated it in the first place, which is all
+// that is required to reconstruct it after a process restart of an
+// in-memory store.
+type FingerprintMapper struct {
+	mtx sync.RWMutex
+
+	// mappings holds, for every raw fingerprint involved in at least one
+	// collision, a map from the canonical label string of a colliding
+	// metric to the fingerprint that metric has been mapped to.
+	mappings map[clientmodel.Fingerprint]map[string]clientmodel.Fingerprint
+}
+
+// NewFingerprintMapper returns a ready-to-use FingerprintMapper with an empty
+// mapping table.
+func NewFingerprintMapper() *FingerprintMapper {
+	return &FingerprintMapper{
+		mappings: map[clientmodel.Fingerprint]map[string]clientmodel.Fingerprint{},
+	}
+}
+
+// MapFingerprint returns the fingerprint under which m should be stored,
+// given that m raw-hashes to raw. occupied is consulted while searching for
+// an unused fingerprint to hand out on a collision; it reports whether some
+// fingerprint is already in use by a series, and is typically a closure over
+// the storage's own fingerprint-keyed map.
+//
+// Callers are expected to take the fast path themselves: if the series
+// already stored under raw carries the exact label set of m, there is no
+// collision, and MapFingerprint does not need to be called at all.
+func (fm *FingerprintMapper) MapFingerprint(raw clientmodel.Fingerprint, m clientmodel.Metric, occupied func(clientmodel.Fingerprint) bool) clientmodel.Fingerprint {
+	canonical := canonicalLabelString(m)
+
+	fm.mtx.RLock()
+	if collisions, ok := fm.mappings[raw]; ok {
+		if mapped, ok := collisions[canonical]; ok {
+			fm.mtx.RUnlock()
+			return mapped
+		}
+	}
+	fm.mtx.RUnlock()
+
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+
+	collisions, ok := fm.mappings[raw]
+	if !ok {
+		collisions = map[string]clientmodel.Fingerprint{}
+		fm.mappings[raw] = collisions
+	} else if mapped, ok := collisions[canonical]; ok {
+		// Another goroutine mapped this exact metric while we were
+		// waiting for the write lock.
+		return mapped
+	}
+
+	mapped := raw
+	for occupied(mapped) || fm.isMappedLocked(mapped) {
+		mapped++
+	}
+	collisions[canonical] = mapped
+	return mapped
+}
+
+// isMappedLocked reports whether fp has already been handed out as the
+// mapped fingerprint of some other metric. The caller must hold fm.mtx.
+func (fm *FingerprintMapper) isMappedLocked(fp clientmodel.Fingerprint) bool {
+	for _, collisions := range fm.mappings {
+		for _, mapped := range collisions {
+			if mapped == fp {
+				return true
+			}
+		}
+	}
+	return false
+}
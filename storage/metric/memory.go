@@ -24,9 +24,15 @@ import (
 	"github.com/prometheus/prometheus/utility"
 )
 
+// valueChunkSize is the number of samples held by a single valueChunk.
 // Assuming sample rate of 1 / 15Hz, this allows for one hour's worth of
-// storage per metric without any major reallocations.
-const initialSeriesArenaSize = 4 * 60
+// samples to be held per chunk before a new one has to be allocated.
+const valueChunkSize = 4 * 60
+
+// fingerprintFromMetric computes the raw fingerprint for a metric. It is a
+// package-level variable so that tests can substitute a hash function that
+// forces fingerprint collisions between otherwise distinct metrics.
+var fingerprintFromMetric = model.NewFingerprintFromMetric
 
 // Models a given sample entry stored in the in-memory arena.
 type value interface {
@@ -42,112 +48,127 @@ func (v singletonValue) get() model.SampleValue {
 	return model.SampleValue(v)
 }
 
+// valueChunk is a fixed-size, append-only block of samples. Once a
+// valueChunk is no longer the tail of its stream, it is sealed and never
+// mutated again, which is what lets readers iterate it without holding any
+// lock.
+type valueChunk struct {
+	values [valueChunkSize]model.SamplePair
+	len    int
+}
+
 type stream struct {
 	sync.RWMutex
 
 	metric clientmodel.Metric
-	values model.Values
+	// chunks holds the stream's samples as an immutable, append-only list
+	// of chunks. The slice header itself, and every chunk but the last,
+	// are only ever replaced or appended to while the write lock is
+	// held. The last ("tail") chunk may have samples appended to its
+	// backing array under the write lock, up to chunk.len; readers that
+	// have snapshotted chunk.len while holding the read lock may safely
+	// read values[:chunk.len] without any further locking, because
+	// appends never touch an index below the length they will
+	// subsequently publish.
+	chunks []*valueChunk
 }
 
 func (s *stream) add(timestamp time.Time, value model.SampleValue) {
 	s.Lock()
 	defer s.Unlock()
 
-	// BUG(all): https://github.com/prometheus/prometheus/pull/265/files#r4336435.
+	if n := len(s.chunks); n == 0 || s.chunks[n-1].len == valueChunkSize {
+		s.chunks = append(s.chunks, &valueChunk{})
+	}
 
-	s.values = append(s.values, model.SamplePair{
+	tail := s.chunks[len(s.chunks)-1]
+	tail.values[tail.len] = model.SamplePair{
 		Timestamp: timestamp,
 		Value:     value,
-	})
+	}
+	tail.len++
 }
 
-func (s *stream) clone() model.Values {
+// snapshot takes a read lock just long enough to capture the current chunk
+// list and the sample count of the (possibly still growing) tail chunk, and
+// returns them as a SeriesIterator. Because sealed chunks are immutable and
+// the tail chunk is only ever appended to beyond the captured length, the
+// returned iterator can be used without holding any lock, regardless of how
+// long the caller takes to consume it or how many further samples are
+// appended to the stream in the meantime.
+func (s *stream) snapshot() *SeriesIterator {
 	s.RLock()
 	defer s.RUnlock()
 
-	// BUG(all): Examine COW technique.
-
-	clone := make(model.Values, len(s.values))
-	copy(clone, s.values)
+	chunks := s.chunks
+	tailLen := 0
+	if n := len(chunks); n > 0 {
+		tailLen = chunks[n-1].len
+	}
+	return newSeriesIterator(chunks, tailLen)
+}
 
-	return clone
+func (s *stream) clone() model.Values {
+	return s.snapshot().Values()
 }
 
 func (s *stream) getValueAtTime(t time.Time) model.Values {
-	s.RLock()
-	defer s.RUnlock()
+	it := s.snapshot()
 
-	// BUG(all): May be avenues for simplification.
-	l := len(s.values)
+	l := it.len()
 	switch l {
 	case 0:
 		return model.Values{}
 	case 1:
-		return model.Values{s.values[0]}
+		return model.Values{it.at(0)}
 	default:
 		index := sort.Search(l, func(i int) bool {
-			return !s.values[i].Timestamp.Before(t)
+			return !it.at(i).Timestamp.Before(t)
 		})
 
 		if index == 0 {
-			return model.Values{s.values[0]}
+			return model.Values{it.at(0)}
 		}
 		if index == l {
-			return model.Values{s.values[l-1]}
+			return model.Values{it.at(l - 1)}
 		}
 
-		if s.values[index].Timestamp.Equal(t) {
-			return model.Values{s.values[index]}
+		if it.at(index).Timestamp.Equal(t) {
+			return model.Values{it.at(index)}
 		}
-		return model.Values{s.values[index-1], s.values[index]}
+		return model.Values{it.at(index - 1), it.at(index)}
 	}
 }
 
 func (s *stream) getBoundaryValues(in model.Interval) model.Values {
-	s.RLock()
-	defer s.RUnlock()
+	it := s.snapshot()
+	l := it.len()
 
-	oldest := sort.Search(len(s.values), func(i int) bool {
-		return !s.values[i].Timestamp.Before(in.OldestInclusive)
+	oldest := sort.Search(l, func(i int) bool {
+		return !it.at(i).Timestamp.Before(in.OldestInclusive)
 	})
 
-	newest := sort.Search(len(s.values), func(i int) bool {
-		return s.values[i].Timestamp.After(in.NewestInclusive)
+	newest := sort.Search(l, func(i int) bool {
+		return it.at(i).Timestamp.After(in.NewestInclusive)
 	})
 
-	resultRange := s.values[oldest:newest]
-	switch len(resultRange) {
+	switch newest - oldest {
 	case 0:
 		return model.Values{}
 	case 1:
-		return model.Values{resultRange[0]}
+		return model.Values{it.at(oldest)}
 	default:
-		return model.Values{resultRange[0], resultRange[len(resultRange)-1]}
+		return model.Values{it.at(oldest), it.at(newest - 1)}
 	}
 }
 
 func (s *stream) getRangeValues(in model.Interval) model.Values {
-	s.RLock()
-	defer s.RUnlock()
-
-	oldest := sort.Search(len(s.values), func(i int) bool {
-		return !s.values[i].Timestamp.Before(in.OldestInclusive)
-	})
-
-	newest := sort.Search(len(s.values), func(i int) bool {
-		return s.values[i].Timestamp.After(in.NewestInclusive)
-	})
-
-	result := make(model.Values, newest-oldest)
-	copy(result, s.values[oldest:newest])
-
-	return result
+	return s.snapshot().RangeValues(in)
 }
 
 func newStream(metric clientmodel.Metric) *stream {
 	return &stream{
 		metric: metric,
-		values: make(model.Values, 0, initialSeriesArenaSize),
 	}
 }
 
@@ -155,6 +176,7 @@ type memorySeriesStorage struct {
 	sync.RWMutex
 
 	wmCache                 *WatermarkCache
+	fpMapper                *FingerprintMapper
 	fingerprintToSeries     map[clientmodel.Fingerprint]*stream
 	labelPairToFingerprints map[model.LabelPair]model.Fingerprints
 	labelNameToFingerprints map[model.LabelName]model.Fingerprints
@@ -179,8 +201,21 @@ func (s *memorySeriesStorage) AppendSample(sample clientmodel.Sample) error {
 	defer s.Unlock()
 
 	metric := sample.Metric
-	fingerprint := model.NewFingerprintFromMetric(metric)
-	series, ok := s.fingerprintToSeries[*fingerprint]
+	raw := fingerprintFromMetric(metric)
+	fingerprint := raw
+	series, ok := s.fingerprintToSeries[*raw]
+
+	if ok && !metricsEqual(series.metric, metric) {
+		// The raw fingerprint is already in use by a different metric:
+		// resolve the collision via the FingerprintMapper and retry the
+		// lookup under the mapped fingerprint.
+		mapped := s.fpMapper.MapFingerprint(*raw, metric, func(fp clientmodel.Fingerprint) bool {
+			_, occupied := s.fingerprintToSeries[fp]
+			return occupied
+		})
+		fingerprint = &mapped
+		series, ok = s.fingerprintToSeries[*fingerprint]
+	}
 
 	if s.wmCache != nil {
 		s.wmCache.Set(fingerprint, &Watermarks{High: sample.Timestamp})
@@ -347,6 +382,7 @@ func (s *memorySeriesStorage) Close() {
 	s.Lock()
 	defer s.Unlock()
 
+	s.fpMapper = NewFingerprintMapper()
 	s.fingerprintToSeries = map[clientmodel.Fingerprint]*stream{}
 	s.labelPairToFingerprints = map[model.LabelPair]model.Fingerprints{}
 	s.labelNameToFingerprints = map[model.LabelName]model.Fingerprints{}
@@ -371,6 +407,7 @@ func (s *memorySeriesStorage) GetAllValuesForLabel(labelName model.LabelName) (v
 
 func NewMemorySeriesStorage(o MemorySeriesOptions) *memorySeriesStorage {
 	return &memorySeriesStorage{
+		fpMapper:                NewFingerprintMapper(),
 		fingerprintToSeries:     make(map[clientmodel.Fingerprint]*stream),
 		labelPairToFingerprints: make(map[model.LabelPair]model.Fingerprints),
 		labelNameToFingerprints: make(map[model.LabelName]model.Fingerprints),
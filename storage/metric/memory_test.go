@@ -0,0 +1,188 @@
+// Copyright 2013 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/model"
+)
+
+// forceFingerprintCollisions overrides fingerprintFromMetric so that every
+// metric hashes to the same raw fingerprint, and returns a function that
+// restores the original hash function.
+func forceFingerprintCollisions() func() {
+	orig := fingerprintFromMetric
+	fingerprintFromMetric = func(m clientmodel.Metric) *clientmodel.Fingerprint {
+		fp := clientmodel.Fingerprint(0)
+		return &fp
+	}
+	return func() { fingerprintFromMetric = orig }
+}
+
+func appendColliding(s *memorySeriesStorage, metrics []clientmodel.Metric) error {
+	base := time.Unix(0, 0)
+	for i, m := range metrics {
+		if err := s.AppendSample(clientmodel.Sample{
+			Metric:    m,
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+			Value:     clientmodel.SampleValue(i),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAppendSampleResolvesFingerprintCollisions(t *testing.T) {
+	defer forceFingerprintCollisions()()
+
+	metrics := []clientmodel.Metric{
+		{"name": "a"},
+		{"name": "b"},
+		{"name": "c"},
+	}
+
+	s := NewMemorySeriesStorage(MemorySeriesOptions{})
+	if err := appendColliding(s, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(s.fingerprintToSeries), len(metrics); got != want {
+		t.Fatalf("got %d distinct series despite colliding raw fingerprints, want %d", got, want)
+	}
+
+	for _, m := range metrics {
+		found := false
+		for _, series := range s.fingerprintToSeries {
+			if metricsEqual(series.metric, m) {
+				found = true
+				values := series.getRangeValues(model.Interval{
+					OldestInclusive: time.Unix(0, 0),
+					NewestInclusive: time.Unix(0, 0).Add(time.Hour),
+				})
+				if len(values) != 1 {
+					t.Errorf("metric %v: got %d samples, want 1", m, len(values))
+				}
+			}
+		}
+		if !found {
+			t.Errorf("metric %v was not stored as its own series", m)
+		}
+	}
+}
+
+func TestAppendSampleReusesFingerprintForSameMetric(t *testing.T) {
+	defer forceFingerprintCollisions()()
+
+	m := clientmodel.Metric{"name": "a"}
+	s := NewMemorySeriesStorage(MemorySeriesOptions{})
+	if err := appendColliding(s, []clientmodel.Metric{m, m, m}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(s.fingerprintToSeries), 1; got != want {
+		t.Fatalf("got %d series for repeated appends of the same metric, want %d", got, want)
+	}
+	for _, series := range s.fingerprintToSeries {
+		if got, want := series.snapshot().len(), 3; got != want {
+			t.Fatalf("got %d samples in the series, want %d", got, want)
+		}
+	}
+}
+
+// TestFingerprintMappingReconstructedOnReplay verifies that a fresh
+// FingerprintMapper, replayed with the same sequence of AppendSample calls,
+// arrives at the same fingerprint assignments as the original -- which is
+// all that is needed to reconstruct the mapping table after a process
+// restart of an in-memory store.
+func TestFingerprintMappingReconstructedOnReplay(t *testing.T) {
+	defer forceFingerprintCollisions()()
+
+	metrics := []clientmodel.Metric{
+		{"name": "a"},
+		{"name": "b"},
+		{"name": "c"},
+	}
+
+	before := NewMemorySeriesStorage(MemorySeriesOptions{})
+	if err := appendColliding(before, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewMemorySeriesStorage(MemorySeriesOptions{})
+	if err := appendColliding(after, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprintFor := func(s *memorySeriesStorage, m clientmodel.Metric) clientmodel.Fingerprint {
+		for fp, series := range s.fingerprintToSeries {
+			if metricsEqual(series.metric, m) {
+				return fp
+			}
+		}
+		t.Fatalf("metric %v not found", m)
+		return 0
+	}
+
+	for _, m := range metrics {
+		if got, want := fingerprintFor(after, m), fingerprintFor(before, m); got != want {
+			t.Errorf("metric %v: replay assigned fingerprint %v, original run assigned %v", m, got, want)
+		}
+	}
+}
+
+// TestStreamCloneIsUnaffectedByConcurrentAppends verifies that a snapshot
+// taken by clone (or getRangeValues/getValueAtTime/getBoundaryValues) does
+// not observe samples appended after the snapshot was taken.
+func TestStreamCloneIsUnaffectedByConcurrentAppends(t *testing.T) {
+	s := newStream(clientmodel.Metric{"name": "a"})
+	base := time.Unix(0, 0)
+	for i := 0; i < valueChunkSize+1; i++ {
+		s.add(base.Add(time.Duration(i)*time.Second), model.SampleValue(i))
+	}
+
+	before := s.clone()
+
+	s.add(base.Add(time.Duration(valueChunkSize+1)*time.Second), 42)
+
+	if got, want := len(before), valueChunkSize+1; got != want {
+		t.Fatalf("got %d values in the pre-append snapshot, want %d", got, want)
+	}
+
+	after := s.clone()
+	if got, want := len(after), valueChunkSize+2; got != want {
+		t.Fatalf("got %d values in the post-append snapshot, want %d", got, want)
+	}
+}
+
+func benchmarkStreamSnapshot(b *testing.B, n int) {
+	s := newStream(clientmodel.Metric{"name": "bench"})
+	base := time.Unix(0, 0)
+	for i := 0; i < n; i++ {
+		s.add(base.Add(time.Duration(i)*time.Second), model.SampleValue(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.snapshot()
+	}
+}
+
+func BenchmarkStreamSnapshot100(b *testing.B)     { benchmarkStreamSnapshot(b, 100) }
+func BenchmarkStreamSnapshot10000(b *testing.B)   { benchmarkStreamSnapshot(b, 10000) }
+func BenchmarkStreamSnapshot1000000(b *testing.B) { benchmarkStreamSnapshot(b, 1000000) }
@@ -0,0 +1,119 @@
+// Copyright 2013 Prometheus Team
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/model"
+)
+
+// SeriesIterator provides read-only access to an immutable, point-in-time
+// snapshot of a stream's samples. Because the snapshot it wraps is never
+// mutated (see stream.snapshot), a SeriesIterator may be used freely without
+// holding any lock, concurrently with further appends to the stream it was
+// taken from.
+//
+// A newly created SeriesIterator is positioned before the first sample;
+// call Next or SeekBefore before the first call to Value.
+type SeriesIterator struct {
+	chunks  []*valueChunk
+	tailLen int
+	pos     int
+}
+
+func newSeriesIterator(chunks []*valueChunk, tailLen int) *SeriesIterator {
+	return &SeriesIterator{
+		chunks:  chunks,
+		tailLen: tailLen,
+		pos:     -1,
+	}
+}
+
+// len returns the number of samples in the snapshot.
+func (it *SeriesIterator) len() int {
+	n := len(it.chunks)
+	if n == 0 {
+		return 0
+	}
+	return (n-1)*valueChunkSize + it.tailLen
+}
+
+// at returns the i'th sample of the snapshot in timestamp order.
+func (it *SeriesIterator) at(i int) model.SamplePair {
+	return it.chunks[i/valueChunkSize].values[i%valueChunkSize]
+}
+
+// SeekBefore positions the iterator at the most recent sample with a
+// timestamp not after t. It returns false, leaving the iterator's position
+// unchanged, if the snapshot has no such sample.
+func (it *SeriesIterator) SeekBefore(t time.Time) bool {
+	n := it.len()
+	index := sort.Search(n, func(i int) bool {
+		return it.at(i).Timestamp.After(t)
+	})
+	if index == 0 {
+		return false
+	}
+	it.pos = index - 1
+	return true
+}
+
+// Next advances the iterator to the next sample in timestamp order. It
+// returns false once the snapshot is exhausted.
+func (it *SeriesIterator) Next() bool {
+	if it.pos+1 >= it.len() {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// Value returns the sample at the iterator's current position. Callers must
+// not call it before a successful call to Next or SeekBefore.
+func (it *SeriesIterator) Value() model.SamplePair {
+	return it.at(it.pos)
+}
+
+// Values materializes every sample of the snapshot into a model.Values
+// slice. Prefer SeekBefore/Next when the full range is not actually needed,
+// as this allocates and copies the entire snapshot.
+func (it *SeriesIterator) Values() model.Values {
+	n := it.len()
+	values := make(model.Values, n)
+	for i := 0; i < n; i++ {
+		values[i] = it.at(i)
+	}
+	return values
+}
+
+// RangeValues materializes the samples of the snapshot falling within in
+// into a model.Values slice.
+func (it *SeriesIterator) RangeValues(in model.Interval) model.Values {
+	n := it.len()
+
+	oldest := sort.Search(n, func(i int) bool {
+		return !it.at(i).Timestamp.Before(in.OldestInclusive)
+	})
+	newest := sort.Search(n, func(i int) bool {
+		return it.at(i).Timestamp.After(in.NewestInclusive)
+	})
+
+	values := make(model.Values, newest-oldest)
+	for i := oldest; i < newest; i++ {
+		values[i-oldest] = it.at(i)
+	}
+	return values
+}